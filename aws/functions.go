@@ -0,0 +1,278 @@
+// Package aws_helper wraps the AWS Lambda SDK calls needed to create,
+// update and garbage collect Lambda functions managed by the deployer.
+package aws_helper
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	deployer "github.com/mdevilliers/lambda-deployer"
+	"github.com/pkg/errors"
+)
+
+// CreateOrUpdateFunction creates the Lambda function described by meta if it
+// does not already exist, or updates its code and configuration if it does.
+// It returns the resulting function configuration, including the newly
+// published version.
+func CreateOrUpdateFunction(svc *lambda.Lambda, s3Bucket, s3Key, role string, meta deployer.FunctionMetadata) (*lambda.FunctionConfiguration, error) {
+
+	envVars := aws.StringMap(map[string]string{})
+	for k, v := range meta.EnvVars {
+		envVars[k] = aws.String(v.(string))
+	}
+
+	_, err := svc.GetFunction(&lambda.GetFunctionInput{
+		FunctionName: aws.String(meta.FunctionName),
+	})
+
+	exists := true
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == lambda.ErrCodeResourceNotFoundException {
+			exists = false
+		} else {
+			return nil, errors.Wrap(err, "error checking for existing function")
+		}
+	}
+
+	if !exists {
+		conf, err := svc.CreateFunction(&lambda.CreateFunctionInput{
+			FunctionName:     aws.String(meta.FunctionName),
+			Description:      aws.String(meta.Description),
+			Handler:          aws.String(meta.Handler),
+			Runtime:          aws.String(meta.Runtime),
+			MemorySize:       aws.Int64(meta.MemorySize),
+			Timeout:          aws.Int64(meta.Timeout),
+			Role:             aws.String(role),
+			Publish:          aws.Bool(true),
+			DeadLetterConfig: deadLetterConfig(meta),
+			VpcConfig:        vpcConfig(meta),
+			TracingConfig:    tracingConfig(meta),
+			KMSKeyArn:        stringOrNil(meta.KMSKeyArn),
+			Layers:           layers(meta),
+			Code: &lambda.FunctionCode{
+				S3Bucket:        aws.String(s3Bucket),
+				S3Key:           aws.String(s3Key),
+				S3ObjectVersion: stringOrNil(meta.S3ObjectVersion),
+			},
+			Environment: &lambda.Environment{
+				Variables: envVars,
+			},
+		})
+
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating function")
+		}
+
+		return conf, nil
+	}
+
+	_, err = svc.UpdateFunctionConfiguration(&lambda.UpdateFunctionConfigurationInput{
+		FunctionName:     aws.String(meta.FunctionName),
+		Description:      aws.String(meta.Description),
+		Handler:          aws.String(meta.Handler),
+		Runtime:          aws.String(meta.Runtime),
+		MemorySize:       aws.Int64(meta.MemorySize),
+		Timeout:          aws.Int64(meta.Timeout),
+		DeadLetterConfig: deadLetterConfig(meta),
+		VpcConfig:        vpcConfig(meta),
+		TracingConfig:    tracingConfig(meta),
+		KMSKeyArn:        stringOrNil(meta.KMSKeyArn),
+		Layers:           layers(meta),
+		Environment: &lambda.Environment{
+			Variables: envVars,
+		},
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error updating function configuration")
+	}
+
+	conf, err := svc.UpdateFunctionCode(&lambda.UpdateFunctionCodeInput{
+		FunctionName:    aws.String(meta.FunctionName),
+		S3Bucket:        aws.String(s3Bucket),
+		S3Key:           aws.String(s3Key),
+		S3ObjectVersion: stringOrNil(meta.S3ObjectVersion),
+		Publish:         aws.Bool(true),
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error updating function code")
+	}
+
+	return conf, nil
+}
+
+// CreateOrUpdateAlias points meta.Alias at the version in conf, creating the
+// alias if it does not already exist. It returns the version the alias
+// previously pointed at, or "" if the alias was just created.
+func CreateOrUpdateAlias(svc *lambda.Lambda, conf *lambda.FunctionConfiguration, meta deployer.FunctionMetadata) (string, error) {
+	return pointAliasAt(svc, conf.FunctionName, aws.String(meta.Alias), conf.Version, nil)
+}
+
+// QuarantineVersion points a "<alias>-quarantine" alias at the version in
+// conf, creating it if necessary. It is used to record a newly published
+// version that failed its post-deploy health check, without disturbing the
+// alias still serving traffic.
+func QuarantineVersion(svc *lambda.Lambda, conf *lambda.FunctionConfiguration, meta deployer.FunctionMetadata) error {
+	_, err := pointAliasAt(svc, conf.FunctionName, aws.String(meta.Alias+"-quarantine"), conf.Version, nil)
+	return err
+}
+
+// ShiftAliasTraffic implements a single step of a CodeDeploy-style linear or
+// canary traffic shift: meta.Alias keeps routing the bulk of its traffic to
+// stableVersion while canaryWeight (0.0-1.0) of invocations are routed to
+// canaryVersion. Callers advance through a deployer.ShiftSchedule by calling
+// this again with the next weight; the final step should pass a weight of 0
+// after switching stableVersion to canaryVersion, collapsing the alias back
+// onto a single version.
+func ShiftAliasTraffic(svc *lambda.Lambda, functionName *string, aliasName string, stableVersion *string, canaryVersion string, canaryWeight float64) error {
+
+	var routingConfig *lambda.AliasRoutingConfiguration
+	if canaryWeight > 0 {
+		routingConfig = &lambda.AliasRoutingConfiguration{
+			AdditionalVersionWeights: map[string]*float64{
+				canaryVersion: aws.Float64(canaryWeight),
+			},
+		}
+	}
+
+	_, err := pointAliasAt(svc, functionName, aws.String(aliasName), stableVersion, routingConfig)
+	return err
+}
+
+// GetAliasVersion returns the version aliasName currently points at, or ""
+// if the alias does not exist yet.
+func GetAliasVersion(svc *lambda.Lambda, functionName *string, aliasName string) (string, error) {
+	state, err := GetAliasState(svc, functionName, aliasName)
+	if err != nil {
+		return "", err
+	}
+	return state.StableVersion, nil
+}
+
+// AliasState is the current routing state of an alias: the stable version
+// serving the bulk of its traffic and, if a gradual traffic shift is in
+// progress, the canary version and the fraction of traffic currently routed
+// to it.
+type AliasState struct {
+	StableVersion string
+	CanaryVersion string
+	CanaryWeight  float64
+}
+
+// GetAliasState returns the current routing state of aliasName, or a zero
+// AliasState (no error) if the alias does not exist yet.
+func GetAliasState(svc *lambda.Lambda, functionName *string, aliasName string) (AliasState, error) {
+
+	existing, err := svc.GetAlias(&lambda.GetAliasInput{
+		FunctionName: functionName,
+		Name:         aws.String(aliasName),
+	})
+
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == lambda.ErrCodeResourceNotFoundException {
+			return AliasState{}, nil
+		}
+
+		return AliasState{}, errors.Wrap(err, "error checking for existing alias")
+	}
+
+	state := AliasState{StableVersion: aws.StringValue(existing.FunctionVersion)}
+
+	if existing.RoutingConfig != nil {
+		for version, weight := range existing.RoutingConfig.AdditionalVersionWeights {
+			state.CanaryVersion = version
+			state.CanaryWeight = aws.Float64Value(weight)
+			break
+		}
+	}
+
+	return state, nil
+}
+
+// pointAliasAt creates or updates the named alias to point at version,
+// optionally with a routing config for gradual traffic shifting. It returns
+// the version the alias previously pointed at, or "" if it was just created.
+func pointAliasAt(svc *lambda.Lambda, functionName, aliasName, version *string, routingConfig *lambda.AliasRoutingConfiguration) (string, error) {
+
+	existing, err := svc.GetAlias(&lambda.GetAliasInput{
+		FunctionName: functionName,
+		Name:         aliasName,
+	})
+
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == lambda.ErrCodeResourceNotFoundException {
+			_, err = svc.CreateAlias(&lambda.CreateAliasInput{
+				FunctionName:    functionName,
+				Name:            aliasName,
+				FunctionVersion: version,
+				RoutingConfig:   routingConfig,
+			})
+
+			if err != nil {
+				return "", errors.Wrap(err, "error creating alias")
+			}
+
+			return "", nil
+		}
+
+		return "", errors.Wrap(err, "error checking for existing alias")
+	}
+
+	previousVersion := aws.StringValue(existing.FunctionVersion)
+
+	_, err = svc.UpdateAlias(&lambda.UpdateAliasInput{
+		FunctionName:    functionName,
+		Name:            aliasName,
+		FunctionVersion: version,
+		RoutingConfig:   routingConfig,
+	})
+
+	if err != nil {
+		return "", errors.Wrap(err, "error updating alias")
+	}
+
+	return previousVersion, nil
+}
+
+func stringOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+func deadLetterConfig(meta deployer.FunctionMetadata) *lambda.DeadLetterConfig {
+	if meta.DeadLetterConfig == nil {
+		return nil
+	}
+	return &lambda.DeadLetterConfig{
+		TargetArn: aws.String(meta.DeadLetterConfig.TargetArn),
+	}
+}
+
+func vpcConfig(meta deployer.FunctionMetadata) *lambda.VpcConfig {
+	if meta.VpcConfig == nil {
+		return nil
+	}
+	return &lambda.VpcConfig{
+		SubnetIds:        aws.StringSlice(meta.VpcConfig.SubnetIds),
+		SecurityGroupIds: aws.StringSlice(meta.VpcConfig.SecurityGroupIds),
+	}
+}
+
+func tracingConfig(meta deployer.FunctionMetadata) *lambda.TracingConfig {
+	if meta.TracingConfig == nil {
+		return nil
+	}
+	return &lambda.TracingConfig{
+		Mode: aws.String(meta.TracingConfig.Mode),
+	}
+}
+
+func layers(meta deployer.FunctionMetadata) []*string {
+	if len(meta.Layers) == 0 {
+		return nil
+	}
+	return aws.StringSlice(meta.Layers)
+}
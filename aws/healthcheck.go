@@ -0,0 +1,52 @@
+package aws_helper
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/pkg/errors"
+)
+
+// InvokeHealthCheck synchronously invokes qualifier (a version or alias) of
+// functionName with payload and treats a Lambda function error, or a
+// response that doesn't match expectedResponse (when non-empty), as a
+// failed health check.
+func InvokeHealthCheck(svc *lambda.Lambda, functionName, qualifier, payload string, expectedResponse []byte) error {
+
+	resp, err := svc.Invoke(&lambda.InvokeInput{
+		FunctionName:   aws.String(functionName),
+		Qualifier:      aws.String(qualifier),
+		InvocationType: aws.String(lambda.InvocationTypeRequestResponse),
+		Payload:        []byte(payload),
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "error invoking health check")
+	}
+
+	if resp.FunctionError != nil {
+		return errors.Errorf("health check invocation returned a function error: %s : %s", aws.StringValue(resp.FunctionError), string(resp.Payload))
+	}
+
+	if len(expectedResponse) > 0 && !jsonEqual(resp.Payload, expectedResponse) {
+		return errors.Errorf("health check response %s did not match expected response %s", string(resp.Payload), string(expectedResponse))
+	}
+
+	return nil
+}
+
+// jsonEqual compares two JSON documents structurally, falling back to a
+// byte-for-byte comparison if either fails to parse.
+func jsonEqual(a, b []byte) bool {
+
+	var ai, bi interface{}
+
+	if json.Unmarshal(a, &ai) != nil || json.Unmarshal(b, &bi) != nil {
+		return bytes.Equal(a, b)
+	}
+
+	return reflect.DeepEqual(ai, bi)
+}
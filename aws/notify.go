@@ -0,0 +1,54 @@
+package aws_helper
+
+import (
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/sns"
+	deployer "github.com/mdevilliers/lambda-deployer"
+	"github.com/pkg/errors"
+)
+
+// PublishDeployEvent publishes a deploy outcome to an SNS topic and/or an
+// EventBridge bus. Either svc may be nil, in which case that destination is
+// skipped; snsTopicArn/eventBusName being empty has the same effect.
+func PublishDeployEvent(snsSvc *sns.SNS, snsTopicArn string, ebSvc *eventbridge.EventBridge, eventBusName string, event deployer.DeployEvent) error {
+
+	body, err := json.Marshal(event)
+
+	if err != nil {
+		return errors.Wrap(err, "error marshaling deploy event")
+	}
+
+	if snsSvc != nil && snsTopicArn != "" {
+		_, err := snsSvc.Publish(&sns.PublishInput{
+			TopicArn: aws.String(snsTopicArn),
+			Message:  aws.String(string(body)),
+			Subject:  aws.String("lambda-deployer: " + event.FunctionName),
+		})
+
+		if err != nil {
+			return errors.Wrap(err, "error publishing deploy event to SNS")
+		}
+	}
+
+	if ebSvc != nil && eventBusName != "" {
+		_, err := ebSvc.PutEvents(&eventbridge.PutEventsInput{
+			Entries: []*eventbridge.PutEventsRequestEntry{
+				{
+					EventBusName: aws.String(eventBusName),
+					Source:       aws.String("lambda-deployer"),
+					DetailType:   aws.String("Deploy"),
+					Detail:       aws.String(string(body)),
+				},
+			},
+		})
+
+		if err != nil {
+			return errors.Wrap(err, "error publishing deploy event to EventBridge")
+		}
+	}
+
+	return nil
+}
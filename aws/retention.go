@@ -0,0 +1,254 @@
+package aws_helper
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	deployer "github.com/mdevilliers/lambda-deployer"
+	"github.com/pkg/errors"
+)
+
+// RetentionEngine applies a deployer.Policy to the published versions of a
+// function, deleting the ones the policy says are safe to remove.
+type RetentionEngine struct {
+	Policy deployer.Policy
+}
+
+// NewRetentionEngine builds a RetentionEngine for the given policy.
+func NewRetentionEngine(policy deployer.Policy) *RetentionEngine {
+	return &RetentionEngine{Policy: policy}
+}
+
+// Apply lists the versions and aliases of meta.FunctionName, computes the
+// set of versions the policy allows to be deleted and, unless the policy is
+// in DryRun mode, deletes them. It emits a CloudWatch EMF metric line
+// recording how many versions were kept and deleted.
+func (e *RetentionEngine) Apply(svc *lambda.Lambda, meta deployer.FunctionMetadata) error {
+
+	versions := []*lambda.FunctionConfiguration{}
+
+	err := svc.ListVersionsByFunctionPages(&lambda.ListVersionsByFunctionInput{
+		FunctionName: aws.String(meta.FunctionName),
+	}, func(page *lambda.ListVersionsByFunctionOutput, lastPage bool) bool {
+		versions = append(versions, page.Versions...)
+		return true
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "error listing versions")
+	}
+
+	aliases := []*lambda.AliasConfiguration{}
+
+	err = svc.ListAliasesPages(&lambda.ListAliasesInput{
+		FunctionName: aws.String(meta.FunctionName),
+	}, func(page *lambda.ListAliasesOutput, lastPage bool) bool {
+		aliases = append(aliases, page.Aliases...)
+		return true
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "error listing aliases")
+	}
+
+	toDelete := e.plan(versions, aliases)
+
+	deployer.EmitEMF("LambdaDeployer", map[string]string{
+		"FunctionName": meta.FunctionName,
+	}, map[string]float64{
+		"VersionsKept":    float64(len(versions) - len(toDelete)),
+		"VersionsDeleted": float64(len(toDelete)),
+	})
+
+	aliasesByVersion := map[string][]*lambda.AliasConfiguration{}
+	for _, alias := range aliases {
+		version := aws.StringValue(alias.FunctionVersion)
+		aliasesByVersion[version] = append(aliasesByVersion[version], alias)
+	}
+
+	if e.Policy.DryRun {
+		for _, v := range toDelete {
+			for _, alias := range aliasesByVersion[aws.StringValue(v.Version)] {
+				log.Printf("retention (dry-run) : would delete alias %s on %s, pointing at version %s", aws.StringValue(alias.Name), meta.FunctionName, aws.StringValue(v.Version))
+			}
+			log.Printf("retention (dry-run) : would delete %s version %s", meta.FunctionName, aws.StringValue(v.Version))
+		}
+		return nil
+	}
+
+	for _, v := range toDelete {
+
+		// a version can't be deleted while an alias still points at it
+		for _, alias := range aliasesByVersion[aws.StringValue(v.Version)] {
+			_, err := svc.DeleteAlias(&lambda.DeleteAliasInput{
+				FunctionName: aws.String(meta.FunctionName),
+				Name:         alias.Name,
+			})
+
+			if err != nil {
+				return errors.Wrapf(err, "error deleting alias %s pointing at version %s", aws.StringValue(alias.Name), aws.StringValue(v.Version))
+			}
+		}
+
+		_, err := svc.DeleteFunction(&lambda.DeleteFunctionInput{
+			FunctionName: aws.String(meta.FunctionName),
+			Qualifier:    v.Version,
+		})
+
+		if err != nil {
+			return errors.Wrapf(err, "error deleting version %s", aws.StringValue(v.Version))
+		}
+	}
+
+	return nil
+}
+
+// plan computes the set of versions that may be deleted under the policy.
+// Rules 1 and 2 remove versions from consideration altogether; rules 3 and
+// 4 then each add the versions they allow to be deleted to the delete set:
+//
+//  1. drop any version protected by an alias name in ProtectedAliases
+//  2. drop any version younger than MinAgeBeforeDelete
+//  3. MaxUnAliasedVersions: of the versions with no alias pointing at them,
+//     keep the N most recently published survivors
+//  4. MaxTotalVersions: if the function still has more total versions than
+//     this, counting the RetainMostRecentAliased most recent aliased
+//     versions as always kept, delete the oldest remaining survivors -
+//     aliased or not - until it doesn't.
+func (e *RetentionEngine) plan(versions []*lambda.FunctionConfiguration, aliases []*lambda.AliasConfiguration) []*lambda.FunctionConfiguration {
+
+	aliasedVersions := map[string]bool{}
+	protectedVersions := map[string]bool{}
+	protectedAliases := map[string]bool{}
+	for _, name := range e.Policy.ProtectedAliases {
+		protectedAliases[name] = true
+	}
+
+	aliasedByRecency := []*lambda.AliasConfiguration{}
+	for _, alias := range aliases {
+		aliasedVersions[aws.StringValue(alias.FunctionVersion)] = true
+		aliasedByRecency = append(aliasedByRecency, alias)
+
+		if protectedAliases[aws.StringValue(alias.Name)] {
+			protectedVersions[aws.StringValue(alias.FunctionVersion)] = true
+		}
+	}
+
+	sort.Slice(aliasedByRecency, func(i, j int) bool {
+		return versionNumber(aws.StringValue(aliasedByRecency[i].FunctionVersion)) > versionNumber(aws.StringValue(aliasedByRecency[j].FunctionVersion))
+	})
+
+	// several aliases may point at the same version, so count distinct versions
+	alwaysKept := map[string]bool{}
+	for _, alias := range aliasedByRecency {
+		if len(alwaysKept) >= e.Policy.RetainMostRecentAliased {
+			break
+		}
+		alwaysKept[aws.StringValue(alias.FunctionVersion)] = true
+	}
+
+	// unaliased survivors, only ever deletable via MaxUnAliasedVersions/MaxTotalVersions
+	eligible := []*lambda.FunctionConfiguration{}
+	// aliased survivors older than the RetainMostRecentAliased cutoff, only
+	// deletable via MaxTotalVersions
+	aliasedEligible := []*lambda.FunctionConfiguration{}
+
+	for _, v := range versions {
+		version := aws.StringValue(v.Version)
+
+		// $LATEST is never a real, deletable version.
+		if version == "$LATEST" {
+			continue
+		}
+
+		if protectedVersions[version] {
+			continue
+		}
+
+		if e.Policy.MinAgeBeforeDelete.Duration > 0 && youngerThan(v, e.Policy.MinAgeBeforeDelete.Duration) {
+			continue
+		}
+
+		if aliasedVersions[version] {
+			if !alwaysKept[version] {
+				aliasedEligible = append(aliasedEligible, v)
+			}
+			continue
+		}
+
+		eligible = append(eligible, v)
+	}
+
+	// oldest first, so the head of each slice is what gets trimmed
+	sort.Slice(eligible, func(i, j int) bool {
+		return versionNumber(aws.StringValue(eligible[i].Version)) < versionNumber(aws.StringValue(eligible[j].Version))
+	})
+	sort.Slice(aliasedEligible, func(i, j int) bool {
+		return versionNumber(aws.StringValue(aliasedEligible[i].Version)) < versionNumber(aws.StringValue(aliasedEligible[j].Version))
+	})
+
+	var toDelete []*lambda.FunctionConfiguration
+	if e.Policy.MaxUnAliasedVersions > 0 && len(eligible) > e.Policy.MaxUnAliasedVersions {
+		toDelete = eligible[:len(eligible)-e.Policy.MaxUnAliasedVersions]
+	}
+
+	if e.Policy.MaxTotalVersions > 0 {
+
+		alreadyDeleted := map[string]bool{}
+		for _, v := range toDelete {
+			alreadyDeleted[aws.StringValue(v.Version)] = true
+		}
+
+		// further deletions, oldest first, drawn from both the full
+		// unaliased pool and the aliased-but-beyond-the-cutoff pool
+		remaining := append(append([]*lambda.FunctionConfiguration{}, eligible...), aliasedEligible...)
+		sort.Slice(remaining, func(i, j int) bool {
+			return versionNumber(aws.StringValue(remaining[i].Version)) < versionNumber(aws.StringValue(remaining[j].Version))
+		})
+
+		totalKept := len(versions) - len(toDelete)
+
+		for _, v := range remaining {
+
+			if totalKept <= e.Policy.MaxTotalVersions {
+				break
+			}
+
+			version := aws.StringValue(v.Version)
+
+			if alreadyDeleted[version] {
+				continue
+			}
+
+			toDelete = append(toDelete, v)
+			alreadyDeleted[version] = true
+			totalKept--
+		}
+	}
+
+	return toDelete
+}
+
+func youngerThan(v *lambda.FunctionConfiguration, d time.Duration) bool {
+	lastModified, err := time.Parse("2006-01-02T15:04:05.000-0700", aws.StringValue(v.LastModified))
+
+	if err != nil {
+		return false
+	}
+
+	return time.Since(lastModified) < d
+}
+
+func versionNumber(version string) int {
+	n := 0
+	for _, r := range version {
+		if r < '0' || r > '9' {
+			return n
+		}
+		n = n*10 + int(r-'0')
+	}
+	return n
+}
@@ -0,0 +1,149 @@
+package aws_helper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	deployer "github.com/mdevilliers/lambda-deployer"
+)
+
+func versionConfig(n int) *lambda.FunctionConfiguration {
+	return &lambda.FunctionConfiguration{
+		Version:      aws.String(fmt.Sprintf("%d", n)),
+		LastModified: aws.String(time.Now().Add(-time.Duration(n) * time.Hour).Format("2006-01-02T15:04:05.000-0700")),
+	}
+}
+
+func alias(name string, version int) *lambda.AliasConfiguration {
+	return &lambda.AliasConfiguration{
+		Name:            aws.String(name),
+		FunctionVersion: aws.String(fmt.Sprintf("%d", version)),
+	}
+}
+
+// TestRetentionEngine_Plan_MaxTotalVersions reproduces the reported bug:
+// with 10 versions, 2 aliased, MaxUnAliasedVersions:3, MaxTotalVersions:4,
+// RetainMostRecentAliased:2, at most 4 versions should survive.
+func TestRetentionEngine_Plan_MaxTotalVersions(t *testing.T) {
+
+	versions := []*lambda.FunctionConfiguration{}
+	for i := 1; i <= 10; i++ {
+		versions = append(versions, versionConfig(i))
+	}
+
+	aliases := []*lambda.AliasConfiguration{
+		alias("prod", 9),
+		alias("staging", 10),
+	}
+
+	engine := NewRetentionEngine(deployer.Policy{
+		MaxUnAliasedVersions:    3,
+		MaxTotalVersions:        4,
+		RetainMostRecentAliased: 2,
+	})
+
+	toDelete := engine.plan(versions, aliases)
+
+	kept := len(versions) - len(toDelete)
+
+	if kept > 4 {
+		t.Fatalf("expected at most 4 versions kept, got %d (deleted %d of %d)", kept, len(toDelete), len(versions))
+	}
+}
+
+func TestRetentionEngine_Plan_MaxUnAliasedVersionsOnly(t *testing.T) {
+
+	versions := []*lambda.FunctionConfiguration{}
+	for i := 1; i <= 5; i++ {
+		versions = append(versions, versionConfig(i))
+	}
+
+	engine := NewRetentionEngine(deployer.Policy{
+		MaxUnAliasedVersions: 2,
+	})
+
+	toDelete := engine.plan(versions, nil)
+
+	if len(toDelete) != 3 {
+		t.Fatalf("expected 3 versions deleted, got %d", len(toDelete))
+	}
+
+	for _, v := range toDelete {
+		version := aws.StringValue(v.Version)
+		if version == "4" || version == "5" {
+			t.Errorf("expected the 2 most recent versions to be kept, found %s in delete set", version)
+		}
+	}
+}
+
+func TestRetentionEngine_Plan_ProtectedAliasedVersionNeverDeleted(t *testing.T) {
+
+	versions := []*lambda.FunctionConfiguration{
+		versionConfig(1),
+		versionConfig(2),
+	}
+
+	aliases := []*lambda.AliasConfiguration{
+		alias("prod", 1),
+		alias("staging", 2),
+	}
+
+	engine := NewRetentionEngine(deployer.Policy{
+		MaxTotalVersions:        1,
+		RetainMostRecentAliased: 0,
+		ProtectedAliases:        []string{"prod"},
+	})
+
+	toDelete := engine.plan(versions, aliases)
+
+	for _, v := range toDelete {
+		if aws.StringValue(v.Version) == "1" {
+			t.Fatalf("version 1 is protected by the %q alias and must never be deleted", "prod")
+		}
+	}
+}
+
+// TestRetentionEngine_Plan_MaxTotalVersionsDeletesOldAliasedVersions checks
+// the documented semantics of MaxTotalVersions (policy.go's
+// "caps the total number of versions (aliased and unaliased) kept"):
+// an aliased version older than the RetainMostRecentAliased cutoff is a
+// candidate for deletion, not permanently exempt.
+func TestRetentionEngine_Plan_MaxTotalVersionsDeletesOldAliasedVersions(t *testing.T) {
+
+	versions := []*lambda.FunctionConfiguration{
+		versionConfig(1),
+		versionConfig(2),
+	}
+
+	aliases := []*lambda.AliasConfiguration{
+		alias("prod", 1),
+		alias("staging", 2),
+	}
+
+	engine := NewRetentionEngine(deployer.Policy{
+		MaxTotalVersions:        1,
+		RetainMostRecentAliased: 1,
+	})
+
+	toDelete := engine.plan(versions, aliases)
+
+	kept := len(versions) - len(toDelete)
+
+	if kept > 1 {
+		t.Fatalf("expected at most 1 version kept, got %d", kept)
+	}
+
+	found := false
+	for _, v := range toDelete {
+		if aws.StringValue(v.Version) == "1" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("expected aliased version 1 (beyond RetainMostRecentAliased) to be deletable, got %#v", toDelete)
+	}
+}
@@ -3,34 +3,33 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"math"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/eawsy/aws-lambda-go-core/service/lambda/runtime"
 	deployer "github.com/mdevilliers/lambda-deployer"
 	aws_helper "github.com/mdevilliers/lambda-deployer/aws"
 	"github.com/pkg/errors"
 )
 
+// defaultWorkerPoolSize bounds how many (record, region) deploys run at once
+// when DEPLOYER_WORKER_POOL_SIZE is not set.
+const defaultWorkerPoolSize = 4
+
 func main() {
 	// DO NOTHING
 }
 
-// Policy holds information for the deployer to implement
-type Policy struct {
-	// MaximumUnAliasedVersions is the maximum unaliased versions of a lambda function
-	// we want to keep. Versions with an alias are never deleted.
-	MaximumUnAliasedVersions int
-
-	// ReduceUnAliasedVersions is true if MaxUnAliasedVersions has been specified
-	ReduceUnAliasedVersions bool
-}
-
 // S3Event struct captures the JSON structure of the event passed when a new
 // object is created in S3
 type S3Event struct {
@@ -47,6 +46,7 @@ type S3Event struct {
 				Sequencer string `json:"sequencer"`
 				Key       string `json:"key"`
 				Size      int    `json:"size"`
+				VersionID string `json:"versionId"`
 			} `json:"object"`
 			Bucket struct {
 				Arn           string `json:"arn"`
@@ -70,10 +70,53 @@ type S3Event struct {
 	} `json:"Records"`
 }
 
-// Handle is called when ever an object is written to S3 via the uploader.
-// We assume this is always a lambda function zip file and that AWS Lambda will error
-// if the file is not of a correct format.
-func Handle(evt json.RawMessage, ctx *runtime.Context) (string, error) {
+// DeployResult is the outcome of deploying a single (bucket, key) artifact
+// to a single target region.
+type DeployResult struct {
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	VersionID    string `json:"version_id,omitempty"`
+	Region       string `json:"region,omitempty"`
+	FunctionName string `json:"function_name,omitempty"`
+	Version      string `json:"version,omitempty"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+}
+
+// HandleResult aggregates the per-record, per-region results of a single
+// invocation of Handle.
+type HandleResult struct {
+	Results []DeployResult `json:"results"`
+}
+
+// artifact identifies a single deduplicated (bucket, key) S3 object that
+// needs deploying, independent of which region(s) it's deployed to.
+type artifact struct {
+	bucket    string
+	key       string
+	versionID string
+}
+
+// deployTarget is a single artifact, with its metadata already read from
+// S3, destined for a single region.
+type deployTarget struct {
+	meta      deployer.FunctionMetadata
+	bucket    string
+	key       string
+	versionID string
+	region    string
+}
+
+// Handle is called whenever one or more objects are written to S3 via the
+// uploader. We assume every record is a lambda function zip file and that
+// AWS Lambda will error if the file is not of a correct format.
+//
+// Records referencing the same (bucket, key) are de-duplicated, keeping the
+// most recent S3 object version seen. Each surviving artifact's metadata is
+// read from S3 once, then deployed to every target region
+// (DEPLOYER_TARGET_REGIONS, or the session's default region if unset)
+// concurrently, bounded by a worker pool.
+func Handle(evt json.RawMessage, ctx *runtime.Context) (HandleResult, error) {
 
 	log.Println("deployer : ", deployer.VersionString())
 	log.Println("handle event : ", string(evt))
@@ -81,13 +124,13 @@ func Handle(evt json.RawMessage, ctx *runtime.Context) (string, error) {
 	role := os.Getenv("DEPLOYER_FUNCTION_ROLE_ARN")
 
 	if role == "" {
-		return "error", errors.New("DEPLOYER_FUNCTION_ROLE_ARN not set")
+		return HandleResult{}, errors.New("DEPLOYER_FUNCTION_ROLE_ARN not set")
 	}
 
 	policy, err := loadPolicy()
 
 	if err != nil {
-		return "error", errors.Wrap(err, "error loading policy")
+		return HandleResult{}, errors.Wrap(err, "error loading policy")
 	}
 
 	s3Event := S3Event{}
@@ -95,64 +138,378 @@ func Handle(evt json.RawMessage, ctx *runtime.Context) (string, error) {
 	err = json.Unmarshal(evt, &s3Event)
 
 	if err != nil {
-		return "error", errors.Wrap(err, "error un-marshaling event json")
+		return HandleResult{}, errors.Wrap(err, "error un-marshaling event json")
 	}
 
-	session, err := session.NewSession()
+	regions := parseRegions(os.Getenv("DEPLOYER_TARGET_REGIONS"))
+
+	artifacts := dedupeRecords(s3Event)
+
+	// metadata is read once per artifact regardless of how many target
+	// regions it's deployed to, using a session that isn't pinned to any
+	// one of them - the source bucket lives in its own region, which may
+	// not be any of the deploy targets.
+	metaSess, err := session.NewSession(aws.NewConfig())
 
 	if err != nil {
-		return "error", err
+		return HandleResult{}, errors.Wrap(err, "error creating aws session")
 	}
 
-	lambdaSvc := lambda.New(session, aws.NewConfig())
-	s3Svc := s3.New(session, aws.NewConfig())
+	s3Svc := s3.New(metaSess, aws.NewConfig())
+
+	results := []DeployResult{}
+	targets := []deployTarget{}
+
+	for _, a := range artifacts {
+
+		meta, metaErr := getMetadata(s3Svc, a.bucket, a.key, a.versionID)
+
+		artifactRegions := regions
+		if len(artifactRegions) == 0 {
+			artifactRegions = []string{""}
+		}
+
+		for _, region := range artifactRegions {
+
+			if metaErr != nil {
+				results = append(results, DeployResult{
+					Bucket:    a.bucket,
+					Key:       a.key,
+					VersionID: a.versionID,
+					Region:    region,
+					Error:     errors.Wrap(metaErr, "error reading metadata from s3 object").Error(),
+				})
+				continue
+			}
+
+			targets = append(targets, deployTarget{
+				meta:      meta,
+				bucket:    a.bucket,
+				key:       a.key,
+				versionID: a.versionID,
+				region:    region,
+			})
+		}
+	}
+
+	deployed := make([]DeployResult, len(targets))
+
+	sem := make(chan struct{}, workerPoolSize())
+	var wg sync.WaitGroup
+
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, t deployTarget) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			deployed[i] = deployOne(role, policy, t)
+		}(i, t)
+	}
+
+	wg.Wait()
+
+	results = append(results, deployed...)
+
+	var firstErr error
+	for _, r := range results {
+		if !r.Success && firstErr == nil {
+			firstErr = errors.Errorf("error deploying %s/%s to %q: %s", r.Bucket, r.Key, r.Region, r.Error)
+		}
+	}
+
+	return HandleResult{Results: results}, firstErr
+}
+
+// dedupeRecords collapses S3 event records that refer to the same
+// (bucket, key) down to the most recent one.
+func dedupeRecords(s3Event S3Event) []artifact {
+
+	type key struct{ bucket, object string }
 
-	bucket := s3Event.Records[0].S3.Bucket.Name
-	key := s3Event.Records[0].S3.Object.Key
+	latest := map[key]string{}
+	order := []key{}
 
-	meta, err := getMetadata(s3Svc, bucket, key)
+	for _, record := range s3Event.Records {
+
+		k := key{bucket: record.S3.Bucket.Name, object: record.S3.Object.Key}
+
+		if _, seen := latest[k]; !seen {
+			order = append(order, k)
+		}
+
+		latest[k] = record.S3.Object.VersionID
+	}
+
+	artifacts := make([]artifact, 0, len(order))
+
+	for _, k := range order {
+		artifacts = append(artifacts, artifact{bucket: k.bucket, key: k.object, versionID: latest[k]})
+	}
+
+	return artifacts
+}
+
+// parseRegions splits DEPLOYER_TARGET_REGIONS on commas. An empty value
+// means "deploy once, to the session's default region".
+func parseRegions(s string) []string {
+
+	if s == "" {
+		return nil
+	}
+
+	parts := strings.Split(s, ",")
+	regions := make([]string, 0, len(parts))
+
+	for _, part := range parts {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			regions = append(regions, trimmed)
+		}
+	}
+
+	return regions
+}
+
+// workerPoolSize returns DEPLOYER_WORKER_POOL_SIZE, or defaultWorkerPoolSize
+// if it is unset or invalid.
+func workerPoolSize() int {
+
+	if s := os.Getenv("DEPLOYER_WORKER_POOL_SIZE"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			return n
+		}
+	}
+
+	return defaultWorkerPoolSize
+}
+
+// shiftScheduleIndex returns the index of weight within schedule (allowing
+// for floating point round-trip error), or -1 if weight doesn't match any
+// step.
+func shiftScheduleIndex(schedule deployer.ShiftSchedule, weight float64) int {
+	for i, w := range schedule {
+		if math.Abs(w-weight) < 1e-9 {
+			return i
+		}
+	}
+	return -1
+}
+
+// deployOne runs the full create/update/health-check/alias/retention
+// pipeline for a single artifact, whose metadata has already been read,
+// against a single region.
+func deployOne(role string, policy deployer.Policy, t deployTarget) DeployResult {
+
+	result := DeployResult{Bucket: t.bucket, Key: t.key, VersionID: t.versionID, Region: t.region, FunctionName: t.meta.FunctionName}
+
+	meta := t.meta
+	var conf *lambda.FunctionConfiguration
+	var previousVersion string
+
+	cfg := aws.NewConfig()
+	if t.region != "" {
+		cfg = cfg.WithRegion(t.region)
+	}
+
+	sess, err := session.NewSession(cfg)
 
 	if err != nil {
-		return "error", errors.Wrap(err, "error reading metadata from s3 object")
+		result.Error = err.Error()
+		return result
 	}
 
+	defer notifyDeployOutcome(sess, &meta, &conf, &t.bucket, &t.key, &t.versionID, &previousVersion, &err)
+
+	lambdaSvc := lambda.New(sess, aws.NewConfig())
+
 	// create or update the lambda function
-	conf, err := aws_helper.CreateOrUpdateFunction(lambdaSvc, bucket, key, role, meta)
+	conf, err = aws_helper.CreateOrUpdateFunction(lambdaSvc, t.bucket, t.key, role, meta)
 
 	if err != nil {
-		return "error", errors.Wrap(err, "error creating or updating lambda function")
+		err = errors.Wrap(err, "error creating or updating lambda function")
+		result.Error = err.Error()
+		return result
 	}
 
-	// update, create the alias
-	err = aws_helper.CreateOrUpdateAlias(lambdaSvc, conf, meta)
+	result.Version = aws.StringValue(conf.Version)
+
+	// read the alias's current state before anything that might quarantine
+	// the new version and return early, so a failed health check still
+	// reports the version that's genuinely still live
+	aliasState, err := aws_helper.GetAliasState(lambdaSvc, conf.FunctionName, meta.Alias)
 
 	if err != nil {
-		return "error", errors.Wrap(err, "error creating or updating alias")
+		err = errors.Wrap(err, "error reading existing alias")
+		result.Error = err.Error()
+		return result
 	}
 
-	// delete unused versions if required
-	if policy.ReduceUnAliasedVersions {
+	previousVersion = aliasState.StableVersion
+
+	// verify the new version is healthy before it ever receives traffic
+	if payload := os.Getenv("DEPLOYER_HEALTHCHECK_PAYLOAD"); payload != "" {
 
-		err = aws_helper.ReduceUnAliasedVersions(lambdaSvc, policy.MaximumUnAliasedVersions, meta)
+		expectedResponse := []byte(os.Getenv("DEPLOYER_HEALTHCHECK_EXPECTED_RESPONSE"))
+
+		err = aws_helper.InvokeHealthCheck(lambdaSvc, meta.FunctionName, aws.StringValue(conf.Version), payload, expectedResponse)
 
 		if err != nil {
-			return "error", errors.Wrap(err, "error deleting UnAliased versions")
+
+			if quarantineErr := aws_helper.QuarantineVersion(lambdaSvc, conf, meta); quarantineErr != nil {
+				log.Println("error quarantining unhealthy version : ", quarantineErr)
+			} else {
+				deployer.EmitEMF("LambdaDeployer", map[string]string{
+					"FunctionName": meta.FunctionName,
+				}, map[string]float64{
+					"Rollbacks": 1,
+				})
+			}
+
+			err = errors.Wrap(err, "health check failed, leaving "+meta.Alias+" on the prior version")
+			result.Error = err.Error()
+			return result
 		}
+	}
+
+	shiftSchedule, err := deployer.ParseShiftSchedule(os.Getenv("DEPLOYER_SHIFT_SCHEDULE"))
 
+	if err != nil {
+		err = errors.Wrap(err, "error parsing DEPLOYER_SHIFT_SCHEDULE")
+		result.Error = err.Error()
+		return result
 	}
 
-	return "ok", nil
+	if len(shiftSchedule) > 0 && previousVersion != "" {
+
+		newVersion := aws.StringValue(conf.Version)
+
+		if aliasState.CanaryVersion == newVersion && aliasState.CanaryWeight > 0 {
+
+			// CreateOrUpdateFunction published nothing new (the code and
+			// configuration were unchanged), so this is the same canary
+			// version we're already mid-shift on: advance to the next step.
+			nextStep := shiftScheduleIndex(shiftSchedule, aliasState.CanaryWeight) + 1
+
+			if nextStep >= len(shiftSchedule)-1 {
+				// final step: collapse the alias onto the new version
+				_, err = aws_helper.CreateOrUpdateAlias(lambdaSvc, conf, meta)
+			} else {
+				err = aws_helper.ShiftAliasTraffic(lambdaSvc, conf.FunctionName, meta.Alias, aws.String(previousVersion), newVersion, shiftSchedule[nextStep])
+			}
+
+		} else {
+			// a genuinely new version: start a fresh canary at the first step
+			err = aws_helper.ShiftAliasTraffic(lambdaSvc, conf.FunctionName, meta.Alias, aws.String(previousVersion), newVersion, shiftSchedule[0])
+		}
+
+		if err != nil {
+			err = errors.Wrap(err, "error shifting alias traffic")
+			result.Error = err.Error()
+			return result
+		}
+
+	} else {
+
+		// update, create the alias
+		previousVersion, err = aws_helper.CreateOrUpdateAlias(lambdaSvc, conf, meta)
 
+		if err != nil {
+			err = errors.Wrap(err, "error creating or updating alias")
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	// delete versions no longer needed, per the retention policy
+	if policy.Enabled() {
+
+		engine := aws_helper.NewRetentionEngine(policy)
+
+		err = engine.Apply(lambdaSvc, meta)
+
+		if err != nil {
+			err = errors.Wrap(err, "error applying retention policy")
+			result.Error = err.Error()
+			return result
+		}
+
+	}
+
+	result.Success = true
+	return result
+}
+
+// notifyDeployOutcome publishes a deploy event to SNS/EventBridge (when
+// configured) and emits a CloudWatch EMF deploy-count metric. It runs as a
+// deferred call so it sees the final error (if any) regardless of which
+// step in deployOne failed, and is itself best-effort: failures to notify are
+// logged but never override the deploy's own result.
+func notifyDeployOutcome(sess *session.Session, meta *deployer.FunctionMetadata, conf **lambda.FunctionConfiguration, bucket, key, versionID, previousVersion *string, handleErr *error) {
+
+	newVersion := ""
+	if *conf != nil {
+		newVersion = aws.StringValue((*conf).Version)
+	}
+
+	event := deployer.DeployEvent{
+		FunctionName:    meta.FunctionName,
+		NewVersion:      newVersion,
+		Alias:           meta.Alias,
+		PreviousVersion: *previousVersion,
+		SourceBucket:    *bucket,
+		SourceKey:       *key,
+		SourceVersionID: *versionID,
+		Success:         *handleErr == nil,
+	}
+
+	if *handleErr != nil {
+		event.Error = (*handleErr).Error()
+	}
+
+	deployer.EmitEMF("LambdaDeployer", map[string]string{
+		"FunctionName": meta.FunctionName,
+	}, map[string]float64{
+		"Deploys": 1,
+	})
+
+	snsTopicArn := os.Getenv("DEPLOYER_SNS_TOPIC_ARN")
+	eventBusName := os.Getenv("DEPLOYER_EVENTBRIDGE_BUS_NAME")
+
+	if snsTopicArn == "" && eventBusName == "" {
+		return
+	}
+
+	var snsSvc *sns.SNS
+	if snsTopicArn != "" {
+		snsSvc = sns.New(sess, aws.NewConfig())
+	}
+
+	var ebSvc *eventbridge.EventBridge
+	if eventBusName != "" {
+		ebSvc = eventbridge.New(sess, aws.NewConfig())
+	}
+
+	err := aws_helper.PublishDeployEvent(snsSvc, snsTopicArn, ebSvc, eventBusName, event)
+
+	if err != nil {
+		log.Println("error publishing deploy event : ", err)
+	}
 }
 
 // getMetadata parses the S3 object metadata
-func getMetadata(svc *s3.S3, s3Bucket, s3Key string) (deployer.FunctionMetadata, error) {
+func getMetadata(svc *s3.S3, s3Bucket, s3Key, s3VersionID string) (deployer.FunctionMetadata, error) {
 
 	req := &s3.HeadObjectInput{
 		Bucket: aws.String(s3Bucket),
 		Key:    aws.String(s3Key),
 	}
 
+	if s3VersionID != "" {
+		req.VersionId = aws.String(s3VersionID)
+	}
+
 	resp, err := svc.HeadObject(req)
 
 	if err != nil {
@@ -172,14 +529,15 @@ func getMetadata(svc *s3.S3, s3Bucket, s3Key string) (deployer.FunctionMetadata,
 	}
 
 	meta := deployer.FunctionMetadata{
-		Description:  *(resp.Metadata[deployer.FunctionDescriptionTag]),
-		FunctionName: *(resp.Metadata[deployer.FunctionNameTag]),
-		Handler:      *(resp.Metadata[deployer.FunctionHandlerTag]),
-		Runtime:      *(resp.Metadata[deployer.FunctionRuntimeTag]),
-		MemorySize:   int64(memorySize),
-		Timeout:      int64(timeout),
-		Alias:        *(resp.Metadata[deployer.FunctionAliasTag]),
-		EnvVars:      map[string]interface{}{},
+		Description:     *(resp.Metadata[deployer.FunctionDescriptionTag]),
+		FunctionName:    *(resp.Metadata[deployer.FunctionNameTag]),
+		Handler:         *(resp.Metadata[deployer.FunctionHandlerTag]),
+		Runtime:         *(resp.Metadata[deployer.FunctionRuntimeTag]),
+		MemorySize:      int64(memorySize),
+		Timeout:         int64(timeout),
+		Alias:           *(resp.Metadata[deployer.FunctionAliasTag]),
+		EnvVars:         map[string]interface{}{},
+		S3ObjectVersion: s3VersionID,
 	}
 
 	// add in any environmental variables set in the terraform
@@ -191,30 +549,71 @@ func getMetadata(svc *s3.S3, s3Bucket, s3Key string) (deployer.FunctionMetadata,
 		return deployer.FunctionMetadata{}, errors.Wrap(err, "error un-marshaling environmental vars")
 	}
 
+	// advanced, optional settings (DLQ, VPC, tracing, KMS, layers) are carried
+	// as a single JSON blob so new settings don't need a new S3 metadata header
+	if advanced := resp.Metadata[deployer.FunctionAdvancedConfigTag]; advanced != nil && *advanced != "" {
+
+		var cfg deployer.AdvancedConfig
+
+		err = json.Unmarshal([]byte(*advanced), &cfg)
+
+		if err != nil {
+			return deployer.FunctionMetadata{}, errors.Wrap(err, "error un-marshaling function-advanced-config")
+		}
+
+		meta.DeadLetterConfig = cfg.DeadLetterConfig
+		meta.VpcConfig = cfg.VpcConfig
+		meta.TracingConfig = cfg.TracingConfig
+		meta.KMSKeyArn = cfg.KMSKeyArn
+		meta.Layers = cfg.Layers
+	}
+
 	return meta, nil
 
 }
 
-func loadPolicy() (Policy, error) {
-
-	maxUnAliasedVersionsStr := os.Getenv("DEPLOYER_POLICY_MAX_UNALIASED_VERSIONS")
+// loadPolicy builds the retention policy from DEPLOYER_POLICY_JSON, e.g.:
+//
+//	{
+//	  "max_unaliased_versions": 5,
+//	  "max_total_versions": 20,
+//	  "retain_most_recent_aliased": 3,
+//	  "min_age_before_delete": "168h",
+//	  "protected_aliases": ["prod"]
+//	}
+//
+// For backwards compatibility, DEPLOYER_POLICY_MAX_UNALIASED_VERSIONS is
+// still honoured as a shorthand for {"max_unaliased_versions": N} when
+// DEPLOYER_POLICY_JSON is not set.
+func loadPolicy() (deployer.Policy, error) {
 
-	maxUnAliasedVersions := int64(0)
-	var reduceUnAliasedVersions bool
-	var err error
+	if policyJSON := os.Getenv("DEPLOYER_POLICY_JSON"); policyJSON != "" {
 
-	if maxUnAliasedVersionsStr != "" {
+		var policy deployer.Policy
 
-		maxUnAliasedVersions, err = strconv.ParseInt(maxUnAliasedVersionsStr, 10, 64)
+		err := json.Unmarshal([]byte(policyJSON), &policy)
 
 		if err != nil {
-			return Policy{}, err
+			return deployer.Policy{}, errors.Wrap(err, "error un-marshaling DEPLOYER_POLICY_JSON")
 		}
-		reduceUnAliasedVersions = true
+
+		return policy, nil
 	}
-	return Policy{
-		MaximumUnAliasedVersions: int(maxUnAliasedVersions),
-		ReduceUnAliasedVersions:  reduceUnAliasedVersions,
+
+	maxUnAliasedVersionsStr := os.Getenv("DEPLOYER_POLICY_MAX_UNALIASED_VERSIONS")
+
+	if maxUnAliasedVersionsStr == "" {
+		return deployer.Policy{}, nil
+	}
+
+	maxUnAliasedVersions, err := strconv.ParseInt(maxUnAliasedVersionsStr, 10, 64)
+
+	if err != nil {
+		return deployer.Policy{}, err
+	}
+
+	return deployer.Policy{
+		MaxUnAliasedVersions: int(maxUnAliasedVersions),
 	}, nil
 
 }
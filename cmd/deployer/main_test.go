@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseRegions(t *testing.T) {
+
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"us-east-1", []string{"us-east-1"}},
+		{"us-east-1,eu-west-1", []string{"us-east-1", "eu-west-1"}},
+		{" us-east-1 , , eu-west-1 ", []string{"us-east-1", "eu-west-1"}},
+	}
+
+	for _, c := range cases {
+		got := parseRegions(c.in)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseRegions(%q) = %#v, want %#v", c.in, got, c.want)
+		}
+	}
+}
+
+func recordJSON(bucket, key, versionID string) string {
+	return `{
+		"s3": {
+			"bucket": {"name": "` + bucket + `"},
+			"object": {"key": "` + key + `", "versionId": "` + versionID + `"}
+		}
+	}`
+}
+
+func decodeS3Event(t *testing.T, records ...string) S3Event {
+	t.Helper()
+
+	raw := `{"Records": [` + joinJSON(records) + `]}`
+
+	var s3Event S3Event
+	if err := json.Unmarshal([]byte(raw), &s3Event); err != nil {
+		t.Fatalf("error unmarshaling test S3Event: %v", err)
+	}
+
+	return s3Event
+}
+
+func joinJSON(parts []string) string {
+	out := ""
+	for i, p := range parts {
+		if i > 0 {
+			out += ","
+		}
+		out += p
+	}
+	return out
+}
+
+func TestDedupeRecords_KeepsLatestVersionPerBucketAndKey(t *testing.T) {
+
+	s3Event := decodeS3Event(t,
+		recordJSON("my-bucket", "fn.zip", "v1"),
+		recordJSON("my-bucket", "fn.zip", "v2"),
+		recordJSON("my-bucket", "other.zip", "v1"),
+	)
+
+	artifacts := dedupeRecords(s3Event)
+
+	if len(artifacts) != 2 {
+		t.Fatalf("expected 2 deduped artifacts, got %d: %#v", len(artifacts), artifacts)
+	}
+
+	byKey := map[string]artifact{}
+	for _, a := range artifacts {
+		byKey[a.key] = a
+	}
+
+	if byKey["fn.zip"].versionID != "v2" {
+		t.Errorf("expected fn.zip to keep the latest version v2, got %q", byKey["fn.zip"].versionID)
+	}
+}
@@ -0,0 +1,110 @@
+// Package deployer implements a Lambda function that deploys AWS Lambda
+// functions from zip files uploaded to S3.
+package deployer
+
+// version is set at build time via -ldflags.
+var version = "dev"
+
+// VersionString returns a human readable version string for logging.
+func VersionString() string {
+	return "lambda-deployer " + version
+}
+
+// S3 object metadata tags used to describe the Lambda function being
+// deployed. These are set by the uploader (e.g. Terraform or a CI job)
+// as user metadata on the S3 object.
+const (
+	FunctionNameTag        = "function-name"
+	FunctionDescriptionTag = "function-description"
+	FunctionHandlerTag     = "function-handler"
+	FunctionRuntimeTag     = "function-runtime"
+	FunctionMemorySizeTag  = "function-memory-size"
+	FunctionTimeoutTag     = "function-timeout"
+	FunctionAliasTag       = "function-alias"
+
+	// FunctionAdvancedConfigTag is the name of the S3 metadata header carrying
+	// a JSON blob of the advanced, optional Lambda settings (dead letter
+	// config, VPC config, tracing config, KMS key and layers) that don't fit
+	// comfortably into their own headers. See AdvancedConfig.
+	FunctionAdvancedConfigTag = "function-advanced-config"
+)
+
+// FunctionMetadata describes everything needed to create or update a
+// Lambda function from an S3 object.
+type FunctionMetadata struct {
+	// FunctionName is the name of the Lambda function to create or update.
+	FunctionName string
+
+	// Description is a human readable description of the function.
+	Description string
+
+	// Handler is the function within the code that Lambda calls to start execution.
+	Handler string
+
+	// Runtime is the Lambda runtime identifier, e.g. "go1.x".
+	Runtime string
+
+	// MemorySize is the amount of memory, in MB, the function is given.
+	MemorySize int64
+
+	// Timeout is the amount of time, in seconds, the function is allowed to run.
+	Timeout int64
+
+	// Alias is the alias that should point at the newly created version.
+	Alias string
+
+	// EnvVars are the environment variables to set on the function.
+	EnvVars map[string]interface{}
+
+	// S3ObjectVersion is the S3 object version ID of the uploaded zip file,
+	// when the source bucket has versioning enabled. When set, it is passed
+	// through to CreateFunction/UpdateFunctionCode so the function is
+	// deployed from the exact bytes that were uploaded, mirroring
+	// Terraform's aws_lambda_function s3_object_version argument.
+	S3ObjectVersion string
+
+	// DeadLetterConfig, if set, routes failed asynchronous invocations to
+	// an SQS queue or SNS topic.
+	DeadLetterConfig *DeadLetterConfig
+
+	// VpcConfig, if set, attaches the function to a VPC.
+	VpcConfig *VpcConfig
+
+	// TracingConfig, if set, controls AWS X-Ray tracing for the function.
+	TracingConfig *TracingConfig
+
+	// KMSKeyArn, if set, is the KMS key used to encrypt the function's
+	// environment variables at rest.
+	KMSKeyArn string
+
+	// Layers is the list of Lambda layer ARNs to attach to the function.
+	Layers []string
+}
+
+// DeadLetterConfig mirrors lambda.DeadLetterConfig.
+type DeadLetterConfig struct {
+	TargetArn string `json:"target_arn"`
+}
+
+// VpcConfig mirrors lambda.VpcConfig.
+type VpcConfig struct {
+	SubnetIds        []string `json:"subnet_ids"`
+	SecurityGroupIds []string `json:"security_group_ids"`
+}
+
+// TracingConfig mirrors lambda.TracingConfig.
+type TracingConfig struct {
+	// Mode is either "Active" or "PassThrough".
+	Mode string `json:"mode"`
+}
+
+// AdvancedConfig is the JSON shape expected in the FunctionAdvancedConfigTag
+// S3 metadata header. It groups the optional, less frequently used Lambda
+// settings so that adding a new one doesn't require a new S3 metadata header.
+type AdvancedConfig struct {
+	DeadLetterConfig *DeadLetterConfig `json:"dead_letter_config,omitempty"`
+	VpcConfig        *VpcConfig        `json:"vpc_config,omitempty"`
+	TracingConfig    *TracingConfig    `json:"tracing_config,omitempty"`
+	KMSKeyArn        string            `json:"kms_key_arn,omitempty"`
+	Layers           []string          `json:"layers,omitempty"`
+}
@@ -0,0 +1,16 @@
+package deployer
+
+// DeployEvent describes the outcome of a single deploy, published to SNS
+// and/or EventBridge so downstream systems (ChatOps, CD dashboards) can
+// react without polling CloudTrail.
+type DeployEvent struct {
+	FunctionName    string `json:"function_name"`
+	NewVersion      string `json:"new_version,omitempty"`
+	Alias           string `json:"alias"`
+	PreviousVersion string `json:"previous_version,omitempty"`
+	SourceBucket    string `json:"source_bucket"`
+	SourceKey       string `json:"source_key"`
+	SourceVersionID string `json:"source_version_id,omitempty"`
+	Success         bool   `json:"success"`
+	Error           string `json:"error,omitempty"`
+}
@@ -0,0 +1,70 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// emfMetadata is the "_aws" block CloudWatch Logs looks for to recognise an
+// Embedded Metric Format log line.
+type emfMetadata struct {
+	Timestamp         int64           `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricMeta `json:"CloudWatchMetrics"`
+}
+
+type emfMetricMeta struct {
+	Namespace  string          `json:"Namespace"`
+	Dimensions [][]string      `json:"Dimensions"`
+	Metrics    []emfMetricUnit `json:"Metrics"`
+}
+
+type emfMetricUnit struct {
+	Name string `json:"Name"`
+}
+
+// EmitEMF writes a single CloudWatch Embedded Metric Format log line to
+// stdout. When running as a Lambda function this is picked up by CloudWatch
+// Logs and turned into custom metrics under namespace, without needing the
+// CloudWatch PutMetricData API or any extra IAM permissions.
+func EmitEMF(namespace string, dimensions map[string]string, metrics map[string]float64) {
+
+	dimensionKeys := make([]string, 0, len(dimensions))
+	for k := range dimensions {
+		dimensionKeys = append(dimensionKeys, k)
+	}
+
+	metricMeta := make([]emfMetricUnit, 0, len(metrics))
+	for name := range metrics {
+		metricMeta = append(metricMeta, emfMetricUnit{Name: name})
+	}
+
+	doc := map[string]interface{}{
+		"_aws": emfMetadata{
+			Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+			CloudWatchMetrics: []emfMetricMeta{
+				{
+					Namespace:  namespace,
+					Dimensions: [][]string{dimensionKeys},
+					Metrics:    metricMeta,
+				},
+			},
+		},
+	}
+
+	for k, v := range dimensions {
+		doc[k] = v
+	}
+
+	for k, v := range metrics {
+		doc[k] = v
+	}
+
+	out, err := json.Marshal(doc)
+
+	if err != nil {
+		return
+	}
+
+	fmt.Println(string(out))
+}
@@ -0,0 +1,75 @@
+package deployer
+
+import "time"
+
+// Policy describes the rules used to decide which published versions of a
+// function should be garbage collected after a deploy. It is loaded from
+// the DEPLOYER_POLICY_JSON environment variable and rules are composable:
+// MaxUnAliasedVersions and MaxTotalVersions each select versions to delete,
+// while MinAgeBeforeDelete and ProtectedAliases exempt versions from both.
+type Policy struct {
+	// MaxUnAliasedVersions is the maximum number of versions with no alias
+	// pointing at them to keep. Older unaliased versions beyond this count
+	// are deleted. Zero means this rule is disabled.
+	MaxUnAliasedVersions int `json:"max_unaliased_versions"`
+
+	// MaxTotalVersions caps the total number of versions (aliased and
+	// unaliased) kept for a function, always retaining the
+	// RetainMostRecentAliased most recently published aliased versions.
+	// Zero means this rule is disabled.
+	MaxTotalVersions int `json:"max_total_versions"`
+
+	// RetainMostRecentAliased is the number of most recently published
+	// aliased versions that MaxTotalVersions will never delete.
+	RetainMostRecentAliased int `json:"retain_most_recent_aliased"`
+
+	// MinAgeBeforeDelete, if set, protects any version younger than this
+	// duration from deletion regardless of the other rules. Expressed as a
+	// Go duration string, e.g. "168h" for 7 days.
+	MinAgeBeforeDelete Duration `json:"min_age_before_delete"`
+
+	// ProtectedAliases lists alias names whose versions must never be
+	// deleted, regardless of the other rules.
+	ProtectedAliases []string `json:"protected_aliases"`
+
+	// DryRun, if true, computes and logs the set of versions that would be
+	// deleted without actually deleting them.
+	DryRun bool `json:"dry_run"`
+}
+
+// Enabled reports whether a rule that deletes versions (MaxUnAliasedVersions
+// or MaxTotalVersions) is active. The other settings only modify those two.
+func (p Policy) Enabled() bool {
+	return p.MaxUnAliasedVersions > 0 || p.MaxTotalVersions > 0
+}
+
+// Duration wraps time.Duration so policies can be authored with human
+// readable strings (e.g. "168h") in the DEPLOYER_POLICY_JSON blob.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON accepts a JSON string parsable by time.ParseDuration.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	s = s[1 : len(s)-1] // strip surrounding quotes
+
+	if s == "" {
+		d.Duration = 0
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(s)
+
+	if err != nil {
+		return err
+	}
+
+	d.Duration = parsed
+	return nil
+}
+
+// MarshalJSON renders the duration back as a Go duration string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + d.Duration.String() + `"`), nil
+}
@@ -0,0 +1,48 @@
+package deployer
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ShiftSchedule is an ordered list of canary traffic weights (0.0-1.0) used
+// to gradually shift traffic from the previous version of a function to the
+// newly deployed one, CodeDeploy linear/canary style. The final weight is
+// always 1.0 once parsed.
+type ShiftSchedule []float64
+
+// ParseShiftSchedule parses a comma separated list of percentages, e.g.
+// "10,50,100", into a ShiftSchedule of fractions ("10,50,100" -> [0.1, 0.5, 1.0]).
+// An empty string yields a nil schedule (no gradual shifting).
+func ParseShiftSchedule(s string) (ShiftSchedule, error) {
+
+	if s == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(s, ",")
+	schedule := make(ShiftSchedule, 0, len(parts))
+
+	for _, part := range parts {
+
+		pct, err := strconv.Atoi(strings.TrimSpace(part))
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid shift schedule step %q", part)
+		}
+
+		if pct <= 0 || pct > 100 {
+			return nil, errors.Errorf("shift schedule step %d%% must be between 1 and 100", pct)
+		}
+
+		schedule = append(schedule, float64(pct)/100.0)
+	}
+
+	if schedule[len(schedule)-1] != 1.0 {
+		schedule = append(schedule, 1.0)
+	}
+
+	return schedule, nil
+}